@@ -0,0 +1,85 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package cli
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/cockroachdb/cockroach/security/ca"
+)
+
+// certCertsDir is shared by all `cockroach cert` subcommands via --certs-dir.
+var certCertsDir string
+
+// CertCmd is the `cockroach cert` command, grouping the create-ca/
+// create-node/create-client subcommands that drive security/ca. It
+// replaces the external openssl recipes previously needed to stand up a
+// secure cluster.
+var CertCmd = &cobra.Command{
+	Use:   "cert",
+	Short: "create CA, node and client certificates",
+	Long: `
+Create and manage the certificates used to run a secure CockroachDB
+cluster, using an in-process certificate authority rather than external
+openssl recipes.
+`,
+}
+
+var createCACmd = &cobra.Command{
+	Use:   "create-ca",
+	Short: "create the cluster CA",
+	Long: `
+Generate a self-signed cluster CA keypair and write it to
+--certs-dir/ca.{crt,key}.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return ca.CreateCA(certCertsDir)
+	},
+}
+
+var createNodeCmd = &cobra.Command{
+	Use:   "create-node <host> [host...]",
+	Short: "create a node certificate",
+	Long: `
+Generate a node keypair signed by the cluster CA and write it to
+--certs-dir/node.{crt,key}. Each argument is a hostname or IP address the
+node may be dialed as; they become the certificate's SANs.
+`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return ca.CreateNodeCert(certCertsDir, args)
+	},
+}
+
+var createClientCmd = &cobra.Command{
+	Use:   "create-client <username>",
+	Short: "create a client certificate",
+	Long: `
+Generate a client keypair for the named SQL user, signed by the cluster
+CA with the username encoded in the certificate's CommonName, and write
+it to --certs-dir/client.<username>.{crt,key}.
+`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return ca.CreateClientCert(certCertsDir, args[0])
+	},
+}
+
+func init() {
+	CertCmd.PersistentFlags().StringVar(&certCertsDir, "certs-dir", "certs",
+		"directory in which to read and write certificates")
+	CertCmd.AddCommand(createCACmd, createNodeCmd, createClientCmd)
+}
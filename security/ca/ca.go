@@ -0,0 +1,247 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+// Package ca implements an in-process certificate authority so that
+// clusters can be bootstrapped with `cockroach cert` instead of hand-rolled
+// openssl recipes. It generates a self-signed cluster CA and uses it to
+// sign node and per-user client certificates, writing them out as
+// ca.crt, node.{crt,key} and client.<user>.{crt,key}. ca.crt and
+// node.{crt,key} are the files security.LoadTLSConfigFromDir reads, and
+// ca.crt the one security.LoadClientTLSConfigFromDir reads.
+package ca
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"time"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+const (
+	caCertFilename = "ca.crt"
+	caKeyFilename  = "ca.key"
+
+	nodeCertFilename = "node.crt"
+	nodeKeyFilename  = "node.key"
+
+	// keyFileMode restricts private key files to owner read/write; certs
+	// are public and use the more permissive certFileMode.
+	keyFileMode  os.FileMode = 0600
+	certFileMode os.FileMode = 0644
+
+	// caValidity and leafValidity are conservative defaults; operators who
+	// need something else can still bring their own certs.
+	caValidity   = 10 * 365 * 24 * time.Hour
+	leafValidity = 5 * 365 * 24 * time.Hour
+)
+
+// clientCertFilename returns the conventional file basenames for a given
+// SQL user's client certificate and key, e.g. "client.root.crt".
+func clientCertFilename(user string) string {
+	return "client." + user + ".crt"
+}
+
+func clientKeyFilename(user string) string {
+	return "client." + user + ".key"
+}
+
+// CreateCA generates a new self-signed cluster CA keypair and writes it to
+// certDir/ca.{crt,key}. It fails if a CA already exists there, to avoid
+// silently invalidating certs that were signed by the previous one.
+func CreateCA(certDir string) error {
+	if _, err := os.Stat(path.Join(certDir, caCertFilename)); err == nil {
+		return util.Error("CA already exists in " + certDir)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   "Cockroach CA",
+			Organization: []string{"Cockroach"},
+		},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	return writeKeyPair(certDir, caCertFilename, caKeyFilename, certDER, key)
+}
+
+// CreateNodeCert generates a node keypair, signs it with the cluster CA,
+// and writes node.crt/node.key to certDir. hosts may contain both
+// hostnames and IP addresses; they become the certificate's SANs so that
+// clients dialing any of them will pass hostname verification.
+func CreateNodeCert(certDir string, hosts []string) error {
+	caCert, caKey, err := loadCA(certDir)
+	if err != nil {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName: "node",
+		},
+		NotBefore:   time.Now().Add(-time.Hour),
+		NotAfter:    time.Now().Add(leafValidity),
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+
+	return writeKeyPair(certDir, nodeCertFilename, nodeKeyFilename, certDER, key)
+}
+
+// CreateClientCert generates a client keypair for user, signs it with the
+// cluster CA with the username encoded in the Subject CommonName, and
+// writes client.<user>.crt/client.<user>.key to certDir. The CommonName is
+// what a PrincipalMap later maps to a SQL user.
+func CreateClientCert(certDir, user string) error {
+	caCert, caKey, err := loadCA(certDir)
+	if err != nil {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName: user,
+		},
+		NotBefore:   time.Now().Add(-time.Hour),
+		NotAfter:    time.Now().Add(leafValidity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+
+	return writeKeyPair(certDir, clientCertFilename(user), clientKeyFilename(user), certDER, key)
+}
+
+// loadCA reads and parses the cluster CA keypair from certDir.
+func loadCA(certDir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certPEM, err := ioutil.ReadFile(path.Join(certDir, caCertFilename))
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := ioutil.ReadFile(path.Join(certDir, caKeyFilename))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil {
+		return nil, nil, util.Error("failed to decode CA certificate PEM")
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, nil, util.Error("failed to decode CA key PEM")
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cert, key, nil
+}
+
+// writeKeyPair PEM-encodes certDER/key and writes them to certDir under
+// certFilename/keyFilename, with the key restricted to keyFileMode.
+func writeKeyPair(certDir, certFilename, keyFilename string, certDER []byte, key *ecdsa.PrivateKey) error {
+	certOut := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	if err := ioutil.WriteFile(path.Join(certDir, certFilename), certOut, certFileMode); err != nil {
+		return err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	keyOut := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return ioutil.WriteFile(path.Join(certDir, keyFilename), keyOut, keyFileMode)
+}
+
+// randomSerial returns a random serial number suitable for a certificate,
+// per the recommendation in the x509 package docs.
+func randomSerial() (*big.Int, error) {
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	return rand.Int(rand.Reader, serialNumberLimit)
+}
@@ -0,0 +1,139 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package security
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// generateTestCert returns a self-signed PEM-encoded cert/key pair with the
+// given CommonName, suitable for exercising certCache without a real CA.
+func generateTestCert(t *testing.T, commonName string) (certPEM, keyPEM []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM
+}
+
+func TestCertCacheReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "node.crt")
+	keyFile := filepath.Join(dir, "node.key")
+
+	certPEM, keyPEM := generateTestCert(t, "first")
+	if err := ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err := newCertCache(certFile, keyFile, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.stop()
+
+	first, err := cache.getCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(first.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf.Subject.CommonName != "first" {
+		t.Fatalf("got CommonName %q, want %q", leaf.Subject.CommonName, "first")
+	}
+
+	certPEM, keyPEM = generateTestCert(t, "second")
+	if err := ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := cache.getCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err = x509.ParseCertificate(second.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf.Subject.CommonName != "second" {
+		t.Fatalf("got CommonName %q, want %q after reload", leaf.Subject.CommonName, "second")
+	}
+
+	// stop must be idempotent and safe to call from a deferred cleanup even
+	// though the test already calls it once more below.
+	cache.stop()
+}
+
+func TestOptionsServerCNAllowList(t *testing.T) {
+	certPEM, keyPEM := generateTestCert(t, "node")
+
+	allowed := Options{Cert: certPEM, Key: keyPEM}.peerVerifier()
+	if err := allowed(nil, chainWithCN("node")); err != nil {
+		t.Errorf("default Options should allow CommonName %q: %v", "node", err)
+	}
+	if err := allowed(nil, chainWithCN("alice")); err == nil {
+		t.Error("default Options should reject a non-node CommonName, got nil error")
+	}
+
+	skipped := Options{Cert: certPEM, Key: keyPEM, SkipCNCheck: true}.peerVerifier()
+	if skipped != nil {
+		t.Error("SkipCNCheck should produce a nil VerifyPeerCertificate hook")
+	}
+}
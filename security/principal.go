@@ -0,0 +1,100 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package security
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+
+	"github.com/cockroachdb/cockroach/util"
+)
+
+// NodeUser is the CommonName that security/ca stamps onto node certs, and
+// the only CommonName InternalCNs allows for node-to-node RPC traffic.
+const NodeUser = "node"
+
+// InternalCNs is the allow-list of CommonNames permitted to authenticate
+// as a cluster node on internal RPC connections. It is passed to
+// VerifyNodeCert; any other CommonName is a misconfigured or malicious
+// peer and the connection is rejected.
+var InternalCNs = map[string]bool{
+	NodeUser: true,
+}
+
+// PrincipalMap maps a client certificate's CommonName to the SQL user it
+// authenticates as. It lets a single client cert (e.g. one per service
+// account) be presented under a CommonName distinct from the SQL username
+// it should map to. A nil or empty map means every CommonName is used
+// verbatim as the SQL principal.
+type PrincipalMap map[string]string
+
+// Principal returns the SQL user cn maps to, or cn itself if m has no
+// entry for it.
+func (m PrincipalMap) Principal(cn string) string {
+	if user, ok := m[cn]; ok {
+		return user
+	}
+	return cn
+}
+
+// PrincipalFromConnState extracts the CommonName of the client
+// certificate's verified leaf. It only returns a principal when the peer's
+// certificate was verified (as RequireAndVerifyClientCert guarantees),
+// since VerifiedChains is empty otherwise.
+func PrincipalFromConnState(cs tls.ConnectionState) (string, bool) {
+	if len(cs.VerifiedChains) == 0 || len(cs.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	return cs.VerifiedChains[0][0].Subject.CommonName, true
+}
+
+type principalContextKey struct{}
+
+// NewContextWithPrincipal returns a context carrying principal as the
+// identity authenticated by the peer's client certificate, to be recovered
+// with PrincipalFromContext. Nothing in this package calls it: neither
+// VerifyNodeCert nor the TLSConfigs built by Options place the principal
+// on a context.
+func NewContextWithPrincipal(ctx context.Context, principal string) context.Context {
+	return context.WithValue(ctx, principalContextKey{}, principal)
+}
+
+// PrincipalFromContext returns the principal stashed by
+// NewContextWithPrincipal, if any.
+func PrincipalFromContext(ctx context.Context) (string, bool) {
+	principal, ok := ctx.Value(principalContextKey{}).(string)
+	return principal, ok
+}
+
+// VerifyNodeCert builds a VerifyPeerCertificate hook for internal
+// node-to-node TLSConfigs: it rejects any client certificate whose
+// CommonName is not in allowedCNs, regardless of whether the chain
+// otherwise verifies against the cluster CA.
+func VerifyNodeCert(allowedCNs map[string]bool) func([][]byte, [][]*x509.Certificate) error {
+	return func(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+		for _, chain := range verifiedChains {
+			if len(chain) == 0 {
+				continue
+			}
+			cn := chain[0].Subject.CommonName
+			if !allowedCNs[cn] {
+				return util.Error("client certificate CommonName " + cn + " is not permitted for node-to-node traffic")
+			}
+		}
+		return nil
+	}
+}
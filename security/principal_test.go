@@ -0,0 +1,56 @@
+// Copyright 2014 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License. See the AUTHORS file
+// for names of contributors.
+
+package security
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+)
+
+func TestPrincipalMapPrincipal(t *testing.T) {
+	m := PrincipalMap{"svc-account": "alice"}
+
+	if principal := m.Principal("svc-account"); principal != "alice" {
+		t.Errorf("got %q, want %q", principal, "alice")
+	}
+	if principal := m.Principal("bob"); principal != "bob" {
+		t.Errorf("unmapped CN: got %q, want %q", principal, "bob")
+	}
+
+	var nilMap PrincipalMap
+	if principal := nilMap.Principal("carol"); principal != "carol" {
+		t.Errorf("nil map: got %q, want %q", principal, "carol")
+	}
+}
+
+func chainWithCN(cn string) [][]*x509.Certificate {
+	return [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: cn}}}}
+}
+
+func TestVerifyNodeCert(t *testing.T) {
+	verify := VerifyNodeCert(InternalCNs)
+
+	if err := verify(nil, chainWithCN(NodeUser)); err != nil {
+		t.Errorf("node cert rejected: %v", err)
+	}
+	if err := verify(nil, chainWithCN("alice")); err == nil {
+		t.Error("non-node cert accepted, want rejection")
+	}
+	if err := verify(nil, nil); err != nil {
+		t.Errorf("no verified chains should not error: %v", err)
+	}
+}
@@ -23,7 +23,9 @@ package security
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"fmt"
 	"io/ioutil"
+	"os"
 	"path"
 	"strings"
 	"sync"
@@ -55,10 +57,18 @@ func ResetReadFileFn() {
 // just a wrapper for tls.Config. If config is nil, we don't use TLS.
 type TLSConfig struct {
 	sync.Mutex
-	config *tls.Config
+	config     *tls.Config
+	principals PrincipalMap
+	// stop tears down any background goroutine (e.g. a certCache's reload
+	// watcher) started while building config. It is nil for TLSConfigs that
+	// started none, e.g. LoadInsecureTLSConfig's.
+	stop func()
 }
 
-// Config returns a copy of the TLS configuration.
+// Config returns a copy of the TLS configuration. GetCertificate/
+// GetClientCertificate callbacks installed by Options.Server()/Client()
+// are function values, so the copy still delegates to them -- the
+// snapshot stays live with respect to certificate reloads.
 func (c *TLSConfig) Config() *tls.Config {
 	c.Lock()
 	defer c.Unlock()
@@ -69,69 +79,75 @@ func (c *TLSConfig) Config() *tls.Config {
 	return &cc
 }
 
+// Principal resolves cn (a client certificate's CommonName, as returned by
+// PrincipalFromConnState) to the SQL user it authenticates as, via the
+// PrincipalMap this TLSConfig was built with, if any.
+func (c *TLSConfig) Principal(cn string) string {
+	c.Lock()
+	defer c.Unlock()
+	return c.principals.Principal(cn)
+}
+
+// Close stops any background certificate-reload goroutine started for this
+// TLSConfig and deregisters its SIGHUP handling. It is safe to call on a
+// TLSConfig that started none (e.g. LoadInsecureTLSConfig's), and safe to
+// call more than once.
+func (c *TLSConfig) Close() {
+	c.Lock()
+	stop := c.stop
+	c.Unlock()
+	if stop != nil {
+		stop()
+	}
+}
+
 // LoadTLSConfigFromDir creates a TLSConfig by loading our keys and certs from the
 // specified directory. The directory must contain the following files:
 // - ca.crt   -- the certificate of the cluster CA
 // - node.crt -- the certificate of this node; should be signed by the CA
 // - node.key -- the private key of this node
 // If the path is prefixed with "embedded=", load the embedded certs.
+// This is exactly the layout produced by security/ca.
+//
+// Unlike LoadTLSConfig, this goes through Options so that node.crt/node.key
+// are reloadable (see Options.ReloadInterval) rather than baked in once.
+//
+// This is a general-purpose server config: it accepts any client cert
+// signed by the cluster CA, not just ones with CommonName "node", so that
+// per-SQL-user certs issued by security/ca authenticate here too. Use
+// PrincipalFromConnState (and a PrincipalMap, if CNs don't match SQL
+// usernames directly) to recover who connected. Callers that only ever
+// expect node-to-node traffic and want the stricter node-only CN
+// allow-list should build their own Options with SkipCNCheck left false.
 func LoadTLSConfigFromDir(certDir string) (*TLSConfig, error) {
 	// TODO(tschottdorf): remove this legacy.
 	if strings.HasPrefix(certDir, EmbeddedPrefix) {
 		certDir = certDir[len(EmbeddedPrefix):]
 	}
-	certPEM, err := readFileFn(path.Join(certDir, "node.crt"))
-	if err != nil {
-		return nil, err
-	}
-	keyPEM, err := readFileFn(path.Join(certDir, "node.key"))
-	if err != nil {
-		return nil, err
-	}
-	caPEM, err := readFileFn(path.Join(certDir, "ca.crt"))
-	if err != nil {
-		return nil, err
-	}
-	return LoadTLSConfig(certPEM, keyPEM, caPEM)
+	return Options{
+		CAFile:      path.Join(certDir, "ca.crt"),
+		CertFile:    path.Join(certDir, "node.crt"),
+		KeyFile:     path.Join(certDir, "node.key"),
+		SkipCNCheck: true,
+	}.Server()
 }
 
 // LoadTLSConfig creates a TLSConfig from the supplied byte strings containing
 // - the certificate of the cluster CA,
 // - the certificate of this node (should be signed by the CA),
 // - the private key of this node.
+// Clients must present a cert signed by the cluster CA; security/ca issues
+// one per node and per SQL user, so there's no more excuse for an
+// unauthenticated client. Like LoadTLSConfigFromDir, this accepts any
+// CommonName the CA vouches for; use PrincipalFromConnState to recover who
+// connected.
 func LoadTLSConfig(certPEM, keyPEM, caPEM []byte) (*TLSConfig, error) {
-	cert, err := tls.X509KeyPair(certPEM, keyPEM)
-	if err != nil {
-		return nil, err
-	}
-
-	certPool := x509.NewCertPool()
-
-	if ok := certPool.AppendCertsFromPEM(caPEM); !ok {
-		err = util.Error("failed to parse PEM data to pool")
-		return nil, err
-	}
-
-	return &TLSConfig{
-		config: &tls.Config{
-			Certificates: []tls.Certificate{cert},
-			// TODO(marc): clients are bad about this. We should switch to
-			// tls.RequireAndVerifyClientCert once client certs are properly set.
-			ClientAuth: tls.VerifyClientCertIfGiven,
-			RootCAs:    certPool,
-			ClientCAs:  certPool,
-
-			// Use the default cipher suite from golang (RC4 is going away in 1.5).
-			// Prefer the server-specified suite.
-			PreferServerCipherSuites: true,
-
-			// Lots of things don't support 1.2. Let's try 1.1.
-			MinVersion: tls.VersionTLS11,
-
-			// Should we disable session resumption? This may break forward secrecy.
-			// SessionTicketsDisabled: true,
-		},
-	}, nil
+	return Options{
+		CACert:      caPEM,
+		Cert:        certPEM,
+		Key:         keyPEM,
+		SkipCNCheck: true,
+	}.Server()
 }
 
 // LoadInsecureTLSConfig creates a TLSConfig that disables TLS.
@@ -141,42 +157,151 @@ func LoadInsecureTLSConfig() *TLSConfig {
 	}
 }
 
-// LoadClientTLSConfigFromDir creates a client TLSConfig by loading the root CA certs from the
-// specified directory. The directory must contain ca.crt.
-func LoadClientTLSConfigFromDir(certDir string) (*TLSConfig, error) {
+// fipsCipherSuites is the whitelist of cipher suites allowed by the FIPS
+// 140-2 approved security function list. Only ECDHE key exchange, with
+// ECDSA or RSA authentication, paired with AES-GCM and a FIPS-approved
+// hash is included.
+var fipsCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+}
+
+// fipsCurvePreferences is the whitelist of elliptic curves allowed by FIPS
+// 140-2; P-256, P-384 and P-521 are the only NIST curves it approves.
+var fipsCurvePreferences = []tls.CurveID{
+	tls.CurveP256,
+	tls.CurveP384,
+	tls.CurveP521,
+}
+
+// fipsSignatureAlgorithms is the whitelist of certificate signature
+// algorithms allowed by FIPS 140-2. A chain containing a leaf or
+// intermediate signed with anything else (e.g. MD5 or plain SHA1) is
+// rejected.
+var fipsSignatureAlgorithms = map[x509.SignatureAlgorithm]bool{
+	x509.SHA256WithRSA:   true,
+	x509.SHA384WithRSA:   true,
+	x509.SHA512WithRSA:   true,
+	x509.ECDSAWithSHA256: true,
+	x509.ECDSAWithSHA384: true,
+	x509.ECDSAWithSHA512: true,
+}
+
+// verifyFIPSChains is installed as VerifyPeerCertificate on FIPS profiles.
+// It re-checks every certificate in the peer's verified chains (after the
+// standard chain verification has already run) to ensure none of them was signed
+// using a non-FIPS-approved signature algorithm.
+func verifyFIPSChains(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+	for _, chain := range verifiedChains {
+		for _, cert := range chain {
+			if !fipsSignatureAlgorithms[cert.SignatureAlgorithm] {
+				return util.Error(fmt.Sprintf("certificate %q uses non-FIPS signature algorithm %v",
+					cert.Subject.CommonName, cert.SignatureAlgorithm))
+			}
+		}
+	}
+	return nil
+}
+
+// fipsOptions is the shared base Options for the FIPS 140-2 server and
+// client profiles: TLS 1.2 or later, a fixed cipher suite and curve
+// whitelist, renegotiation disabled, and rejection of any peer certificate
+// chain signed with a non-FIPS signature algorithm.
+func fipsOptions() Options {
+	return Options{
+		MinVersion:            tls.VersionTLS12,
+		CipherSuites:          fipsCipherSuites,
+		CurvePreferences:      fipsCurvePreferences,
+		Renegotiation:         tls.RenegotiateNever,
+		VerifyPeerCertificate: verifyFIPSChains,
+	}
+}
+
+// LoadFIPSTLSConfigFromDir creates a FIPS 140-2 compliant server TLSConfig
+// by loading our keys and certs from the specified directory, using the
+// same file layout as LoadTLSConfigFromDir.
+func LoadFIPSTLSConfigFromDir(certDir string) (*TLSConfig, error) {
 	if strings.HasPrefix(certDir, EmbeddedPrefix) {
 		certDir = certDir[len(EmbeddedPrefix):]
 	}
-	caPEM, err := readFileFn(path.Join(certDir, "ca.crt"))
-	if err != nil {
-		return nil, err
-	}
-	return LoadClientTLSConfig(caPEM)
+	opts := fipsOptions()
+	opts.CAFile = path.Join(certDir, "ca.crt")
+	opts.CertFile = path.Join(certDir, "node.crt")
+	opts.KeyFile = path.Join(certDir, "node.key")
+	return opts.Server()
 }
 
-// LoadClientTLSConfig creates a client TLSConfig from the supplied byte strings containing
-// the certificate of the cluster CA.
-func LoadClientTLSConfig(caPEM []byte) (*TLSConfig, error) {
-	certPool := x509.NewCertPool()
+// LoadFIPSTLSConfig creates a server TLSConfig restricted to FIPS 140-2
+// approved primitives. Operators deploying into regulated environments can
+// use this instead of hand-editing tls.Config.
+func LoadFIPSTLSConfig(certPEM, keyPEM, caPEM []byte) (*TLSConfig, error) {
+	opts := fipsOptions()
+	opts.CACert = caPEM
+	opts.Cert = certPEM
+	opts.Key = keyPEM
+	return opts.Server()
+}
 
-	if ok := certPool.AppendCertsFromPEM(caPEM); !ok {
-		err := util.Error("failed to parse PEM data to pool")
-		return nil, err
+// LoadFIPSClientTLSConfigFromDir creates a FIPS 140-2 compliant client
+// TLSConfig by loading the root CA certs from the specified directory.
+// serverName is used for hostname verification of the server's
+// certificate, as in LoadClientTLSConfigFromDir.
+func LoadFIPSClientTLSConfigFromDir(certDir string, serverName string) (*TLSConfig, error) {
+	if strings.HasPrefix(certDir, EmbeddedPrefix) {
+		certDir = certDir[len(EmbeddedPrefix):]
 	}
+	opts := fipsOptions()
+	opts.CAFile = path.Join(certDir, "ca.crt")
+	opts.ServerName = serverName
+	return opts.Client()
+}
 
-	return &TLSConfig{
-		config: &tls.Config{
-			RootCAs: certPool,
-			// TODO(marc): remove once we have a certificate deployment story in place.
-			InsecureSkipVerify: true,
+// LoadFIPSClientTLSConfig creates a FIPS 140-2 compliant client TLSConfig
+// from the supplied CA certificate, restricted to the same cipher suite,
+// curve and signature algorithm whitelists as LoadFIPSTLSConfig. serverName
+// is used for hostname verification of the server's certificate, as in
+// LoadClientTLSConfig.
+func LoadFIPSClientTLSConfig(caPEM []byte, serverName string) (*TLSConfig, error) {
+	opts := fipsOptions()
+	opts.CACert = caPEM
+	opts.ServerName = serverName
+	return opts.Client()
+}
 
-			// Use only TLS v1.2
-			MinVersion: tls.VersionTLS12,
-		},
-	}, nil
+// LoadClientTLSConfigFromDir creates a client TLSConfig by loading the root CA certs from the
+// specified directory. The directory need not contain ca.crt: if it's
+// missing, the system root pool is used instead. serverName is used for
+// hostname verification of the server's certificate and is typically the
+// dial target.
+func LoadClientTLSConfigFromDir(certDir string, serverName string) (*TLSConfig, error) {
+	if strings.HasPrefix(certDir, EmbeddedPrefix) {
+		certDir = certDir[len(EmbeddedPrefix):]
+	}
+	caFile := path.Join(certDir, "ca.crt")
+	if _, err := readFileFn(caFile); err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		caFile = ""
+	}
+	return Options{CAFile: caFile, ServerName: serverName}.Client()
+}
+
+// LoadClientTLSConfig creates a client TLSConfig from the supplied CA
+// certificate of the cluster and the name of the server being dialed. The
+// CA pool is seeded from the platform's system root pool (falling back to
+// an empty pool if the system pool can't be loaded); caPEM, if non-empty,
+// is appended to that pool rather than replacing it, so a cluster CA can
+// be trusted alongside certs issued by public CAs. serverName drives
+// hostname verification of the server's certificate.
+func LoadClientTLSConfig(caPEM []byte, serverName string) (*TLSConfig, error) {
+	return Options{CACert: caPEM, ServerName: serverName}.Client()
 }
 
-// LoadInsecureClientTLSConfig creates a TLSConfig that disables TLS.
+// LoadInsecureClientTLSConfig creates a TLSConfig that disables verification
+// of the peer's certificate. It should only be used for testing.
 func LoadInsecureClientTLSConfig() *TLSConfig {
 	return &TLSConfig{
 		config: &tls.Config{